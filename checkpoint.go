@@ -0,0 +1,147 @@
+package hessfree
+
+import (
+	"encoding/gob"
+	"io"
+	"math/rand"
+
+	"github.com/unixpickle/autofunc"
+	"github.com/unixpickle/num-analysis/linalg"
+	"github.com/unixpickle/sgd"
+)
+
+// checkpointVersion is bumped whenever the on-disk
+// checkpoint format changes in a way that isn't
+// backward-compatible with gob's built-in field matching
+// (e.g. a field is removed or re-purposed).
+const checkpointVersion = 1
+
+// trainerCheckpoint is the gob-encodable snapshot of a
+// Trainer's progress. Parameters are keyed by their
+// position in Learner.Parameters(), since
+// *autofunc.Variable pointers aren't stable across
+// process restarts.
+type trainerCheckpoint struct {
+	Version           int
+	Epoch             int
+	MiniBatch         int
+	RandSeed          int64
+	LastSolution      []linalg.Vector
+	HasSolution       bool
+	Parameters        []linalg.Vector
+	DampingCoeff      float64
+	HasDampingLearner bool
+}
+
+// SaveCheckpoint writes the Trainer's state to w so that
+// training can be resumed: the current epoch/mini-batch
+// index, the shuffle RNG seed, lastSolution, the
+// learner's parameter vectors, and (if Learner is a
+// *DampingLearner) its DampingCoeff.
+//
+// A resumed Train starts at the first mini-batch of the
+// saved epoch, shuffled with the saved seed (not the
+// shuffle of the interrupted epoch); the restored
+// mini-batch index is reset to 0 rather than skipped to.
+func (t *Trainer) SaveCheckpoint(w io.Writer) error {
+	params := t.Learner.Parameters()
+	data := trainerCheckpoint{
+		Version:    checkpointVersion,
+		Epoch:      t.epoch,
+		MiniBatch:  t.miniBatch,
+		RandSeed:   t.randSeed,
+		Parameters: make([]linalg.Vector, len(params)),
+	}
+	for i, p := range params {
+		data.Parameters[i] = p.Vector
+	}
+	if t.lastSolution != nil {
+		data.HasSolution = true
+		data.LastSolution = deltaToSlice(t.lastSolution, params)
+	}
+	if dl, ok := t.Learner.(*DampingLearner); ok {
+		data.HasDampingLearner = true
+		data.DampingCoeff = dl.DampingCoeff
+	}
+	return gob.NewEncoder(w).Encode(&data)
+}
+
+// LoadCheckpoint restores Trainer state previously
+// written by SaveCheckpoint, including the underlying
+// Learner's parameter vectors. Train() should be called
+// on the same Trainer (with the same Learner) afterwards
+// to resume.
+func (t *Trainer) LoadCheckpoint(r io.Reader) error {
+	var data trainerCheckpoint
+	if err := gob.NewDecoder(r).Decode(&data); err != nil {
+		return err
+	}
+
+	params := t.Learner.Parameters()
+	for i, p := range params {
+		if i < len(data.Parameters) {
+			copy(p.Vector, data.Parameters[i])
+		}
+	}
+
+	t.epoch = data.Epoch
+	t.miniBatch = data.MiniBatch
+	t.randSeed = data.RandSeed
+
+	if data.HasSolution {
+		t.lastSolution = sliceToDelta(data.LastSolution, params)
+	}
+
+	if data.HasDampingLearner {
+		if dl, ok := t.Learner.(*DampingLearner); ok {
+			dl.DampingCoeff = data.DampingCoeff
+		}
+	}
+
+	return nil
+}
+
+func deltaToSlice(d ConstParamDelta, params []*autofunc.Variable) []linalg.Vector {
+	if d == nil {
+		return nil
+	}
+	res := make([]linalg.Vector, len(params))
+	for i, p := range params {
+		res[i] = d[p]
+	}
+	return res
+}
+
+func sliceToDelta(vecs []linalg.Vector, params []*autofunc.Variable) ConstParamDelta {
+	if vecs == nil {
+		return nil
+	}
+	res := ConstParamDelta{}
+	for i, p := range params {
+		if i < len(vecs) {
+			res[p] = vecs[i]
+		}
+	}
+	return res
+}
+
+// seededShuffle shuffles s in place using a *rand.Rand
+// seeded from t.randSeed (generating one if this is the
+// first call), so that the shuffle sequence is
+// reproducible across a checkpoint/restore cycle. Unlike
+// sgd.ShuffleSampleSet, this never calls rand.Seed on the
+// package-level math/rand source, so it can't reset a
+// concurrent consumer of math/rand elsewhere in the
+// process (e.g. another Trainer).
+func (t *Trainer) seededShuffle(s sgd.SampleSet) {
+	if t.randSeed == 0 {
+		t.randSeed = rand.Int63()
+	}
+	r := rand.New(rand.NewSource(t.randSeed))
+	t.randSeed = r.Int63()
+
+	for i := s.Len() - 1; i > 0; i-- {
+		j := r.Intn(i + 1)
+		s.Swap(i, j)
+	}
+}
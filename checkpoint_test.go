@@ -0,0 +1,74 @@
+package hessfree
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestCheckpointRoundTrip trains a DampingLearner for a
+// few epochs, saves a checkpoint, then restores it onto a
+// fresh Trainer/Learner pair and checks that every piece
+// of state SaveCheckpoint claims to capture (epoch,
+// mini-batch, RNG seed, lastSolution, and the
+// DampingLearner's DampingCoeff) survives the round trip.
+func TestCheckpointRoundTrip(t *testing.T) {
+	target := []float64{1, -2, 0.5, 3}
+	samples := fakeSampleSet(8)
+
+	newTrainer := func() (*Trainer, *DampingLearner) {
+		learner := &DampingLearner{WrappedLearner: newQuadraticLearner(target)}
+		trainer := &Trainer{
+			Learner:   learner,
+			Samples:   samples,
+			BatchSize: samples.Len(),
+			UI:        &fakeUI{maxEpoch: 3},
+		}
+		return trainer, learner
+	}
+
+	trainer, learner := newTrainer()
+	trainer.Train()
+
+	var buf bytes.Buffer
+	if err := trainer.SaveCheckpoint(&buf); err != nil {
+		t.Fatalf("SaveCheckpoint failed: %v", err)
+	}
+
+	restoredTrainer, restoredLearner := newTrainer()
+	if err := restoredTrainer.LoadCheckpoint(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("LoadCheckpoint failed: %v", err)
+	}
+
+	if restoredTrainer.epoch != trainer.epoch {
+		t.Errorf("epoch: got %v, expected %v", restoredTrainer.epoch, trainer.epoch)
+	}
+	if restoredTrainer.miniBatch != trainer.miniBatch {
+		t.Errorf("miniBatch: got %v, expected %v", restoredTrainer.miniBatch, trainer.miniBatch)
+	}
+	if restoredTrainer.randSeed != trainer.randSeed {
+		t.Errorf("randSeed: got %v, expected %v", restoredTrainer.randSeed, trainer.randSeed)
+	}
+	if restoredLearner.DampingCoeff != learner.DampingCoeff {
+		t.Errorf("DampingCoeff: got %v, expected %v",
+			restoredLearner.DampingCoeff, learner.DampingCoeff)
+	}
+
+	wrapped := restoredLearner.WrappedLearner.(*quadraticLearner)
+	origWrapped := learner.WrappedLearner.(*quadraticLearner)
+	for i, p := range wrapped.params {
+		if p.Vector[0] != origWrapped.params[i].Vector[0] {
+			t.Errorf("param %d: got %v, expected %v", i, p.Vector[0], origWrapped.params[i].Vector[0])
+		}
+	}
+
+	if trainer.lastSolution == nil || restoredTrainer.lastSolution == nil {
+		t.Fatalf("lastSolution: got %v, expected %v", restoredTrainer.lastSolution, trainer.lastSolution)
+	}
+	for i, p := range wrapped.params {
+		got := restoredTrainer.lastSolution[p][0]
+		expected := trainer.lastSolution[origWrapped.params[i]][0]
+		if got != expected {
+			t.Errorf("lastSolution %d: got %v, expected %v", i, got, expected)
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package hessfree
+
+import (
+	"github.com/unixpickle/autofunc"
+	"github.com/unixpickle/num-analysis/linalg"
+	"github.com/unixpickle/sgd"
+)
+
+const (
+	defaultFisherDecay   = 0.95
+	defaultFisherEpsilon = 1e-4
+
+	defaultTrustLow  = 0.25
+	defaultTrustHigh = 0.75
+)
+
+// A DampingStrategy computes the penalty term added to
+// an Objective to keep the quadratic approximation
+// trustworthy, and controls how the damping coefficient
+// evolves between mini-batches.
+//
+// DampingLearner uses ScaledIdentityDamping (the
+// heuristic from Martens (2010)) unless a different
+// strategy is set.
+type DampingStrategy interface {
+	// Term wraps wrapped with this strategy's penalty,
+	// scaled by coeff.
+	Term(wrapped Objective, coeff float64) Objective
+
+	// NextCoeff returns the damping coefficient to use for
+	// the next mini-batch, given the coefficient used for
+	// this one and the achieved-vs-predicted reduction
+	// ratio observed after Adjust.
+	NextCoeff(prevCoeff, trust float64) float64
+}
+
+// ScaledIdentityDamping is the scalar-identity damping
+// term λ·‖δ‖², adjusted with the fixed 3/2, 2/3 heuristic
+// from Martens (2010). It is the default DampingStrategy.
+type ScaledIdentityDamping struct{}
+
+func (ScaledIdentityDamping) Term(wrapped Objective, coeff float64) Objective {
+	return &dampedObjective{WrappedObjective: wrapped, Coeff: coeff}
+}
+
+func (ScaledIdentityDamping) NextCoeff(prevCoeff, trust float64) float64 {
+	if trust < 0.25 {
+		return prevCoeff * 3.0 / 2.0
+	} else if trust > 0.75 {
+		return prevCoeff * 2.0 / 3.0
+	}
+	return prevCoeff
+}
+
+// TikhonovDamping penalizes deltas using a diagonal
+// preconditioner derived from the empirical Fisher
+// information, i.e. a running average of the squared
+// per-parameter gradient, rather than a flat identity.
+// This penalizes changes to parameters that consistently
+// see large gradients more heavily than the others.
+//
+// Decay controls the exponential moving average rate
+// (default defaultFisherDecay) and Epsilon is added to
+// the Fisher estimate before use to keep it positive
+// definite (default defaultFisherEpsilon).
+type TikhonovDamping struct {
+	Decay   float64
+	Epsilon float64
+
+	fisher ConstParamDelta
+}
+
+func (t *TikhonovDamping) Term(wrapped Objective, coeff float64) Objective {
+	return &tikhonovObjective{
+		WrappedObjective: wrapped,
+		Coeff:            coeff,
+		Fisher:           t.fisher,
+		Epsilon:          t.epsilon(),
+	}
+}
+
+func (t *TikhonovDamping) NextCoeff(prevCoeff, trust float64) float64 {
+	return ScaledIdentityDamping{}.NextCoeff(prevCoeff, trust)
+}
+
+// Observe updates the running Fisher estimate using the
+// gradient computed for the most recent mini-batch.
+func (t *TikhonovDamping) Observe(grad ConstParamDelta) {
+	decay := t.Decay
+	if decay == 0 {
+		decay = defaultFisherDecay
+	}
+	if t.fisher == nil {
+		t.fisher = ConstParamDelta{}
+	}
+	for variable, vec := range grad {
+		sq, ok := t.fisher[variable]
+		if !ok {
+			sq = make(linalg.Vector, len(vec))
+			t.fisher[variable] = sq
+		}
+		for i, x := range vec {
+			sq[i] = decay*sq[i] + (1-decay)*x*x
+		}
+	}
+}
+
+func (t *TikhonovDamping) epsilon() float64 {
+	if t.Epsilon == 0 {
+		return defaultFisherEpsilon
+	}
+	return t.Epsilon
+}
+
+type tikhonovObjective struct {
+	WrappedObjective Objective
+	Coeff            float64
+	Fisher           ConstParamDelta
+	Epsilon          float64
+}
+
+func (t *tikhonovObjective) fisherScale(variable *autofunc.Variable, i int) float64 {
+	if t.Fisher == nil {
+		return t.Epsilon
+	}
+	if vec, ok := t.Fisher[variable]; ok && i < len(vec) {
+		return vec[i] + t.Epsilon
+	}
+	return t.Epsilon
+}
+
+func (t *tikhonovObjective) Quad(delta ConstParamDelta, s sgd.SampleSet) float64 {
+	res := t.WrappedObjective.Quad(delta, s)
+	scaler := t.Coeff * float64(s.Len())
+	for variable, subDelta := range delta {
+		for i, x := range subDelta {
+			res += scaler * t.fisherScale(variable, i) * x * x
+		}
+	}
+	return res
+}
+
+func (t *tikhonovObjective) QuadGrad(delta ConstParamDelta, s sgd.SampleSet) ConstParamDelta {
+	res := t.WrappedObjective.QuadGrad(delta, s)
+	scaler := 2 * t.Coeff * float64(s.Len())
+	for variable, subDelta := range delta {
+		resVec := res[variable]
+		for i, x := range subDelta {
+			resVec[i] += scaler * t.fisherScale(variable, i) * x
+		}
+	}
+	return res
+}
+
+func (t *tikhonovObjective) QuadHessian(delta, solution ConstParamDelta,
+	s sgd.SampleSet) (ConstParamDelta, float64) {
+	res, quadValue := t.WrappedObjective.QuadHessian(delta, solution, s)
+	scaler := 2 * t.Coeff * float64(s.Len())
+	for variable, subDelta := range delta {
+		resVec := res[variable]
+		for i, x := range subDelta {
+			resVec[i] += scaler * t.fisherScale(variable, i) * x
+		}
+	}
+	quadScaler := t.Coeff * float64(s.Len())
+	for variable, subSolution := range solution {
+		for i, x := range subSolution {
+			quadValue += quadScaler * t.fisherScale(variable, i) * x * x
+		}
+	}
+	return res, quadValue
+}
+
+func (t *tikhonovObjective) Objective(delta ConstParamDelta, s sgd.SampleSet) float64 {
+	return t.WrappedObjective.Objective(delta, s)
+}
+
+// StructuralDamping adds the penalty described by Martens
+// & Sutskever (2011) for recurrent networks: rather than
+// damping the raw parameter change, it damps the change
+// induced in a hidden-state batcher's output. This keeps
+// the quadratic approximation trustworthy even when small
+// parameter changes cause large changes in the unrolled
+// hidden state.
+type StructuralDamping struct {
+	// HiddenState is the RBatcher whose output change is
+	// penalized, e.g. the recurrence's state-update layer.
+	HiddenState autofunc.RBatcher
+
+	// BatchInputs derives the hidden-state batcher's input
+	// vector and sample count from a mini-batch. It is
+	// called once per Quad/QuadGrad/QuadHessian/Objective
+	// call, with the same SampleSet the wrapped Objective is
+	// being evaluated on, so the penalty always reflects the
+	// samples actually being trained on rather than a batch
+	// fixed at construction time.
+	BatchInputs func(s sgd.SampleSet) (ins linalg.Vector, n int)
+}
+
+func (s *StructuralDamping) Term(wrapped Objective, coeff float64) Objective {
+	return &structuralObjective{
+		WrappedObjective: wrapped,
+		Coeff:            coeff,
+		Linearizer:       &Linearizer{Batcher: s.HiddenState},
+		BatchInputs:      s.BatchInputs,
+	}
+}
+
+func (s *StructuralDamping) NextCoeff(prevCoeff, trust float64) float64 {
+	return ScaledIdentityDamping{}.NextCoeff(prevCoeff, trust)
+}
+
+type structuralObjective struct {
+	WrappedObjective Objective
+	Coeff            float64
+	Linearizer       *Linearizer
+	BatchInputs      func(s sgd.SampleSet) (ins linalg.Vector, n int)
+}
+
+// stateChangeNormSquared approximates ‖h(θ+δ) - h(θ)‖²
+// for the hidden-state batcher by evaluating its
+// linearization's R-output on delta, which is exactly
+// the first-order change in the batcher's output induced
+// by delta.
+func (s *structuralObjective) stateChangeNormSquared(delta ConstParamDelta, set sgd.SampleSet) float64 {
+	ins, n := s.BatchInputs(set)
+
+	rDelta := ParamRDelta{}
+	for variable, vec := range delta {
+		rDelta[variable] = autofunc.NewRVariable(variable, autofunc.RVector{variable: vec})
+	}
+	out := s.Linearizer.LinearBatchR(rDelta, ins, n)
+	return out.ROutput().Dot(out.ROutput())
+}
+
+// stateChangeGrad computes the gradient of
+// n*Coeff*stateChangeNormSquared(delta, set) with respect
+// to delta, by back-propagating through the same
+// Linearizer used to compute stateChangeNormSquared: the
+// R-output is the hidden-state change J·delta, so
+// propagating 2*n*Coeff*(J·delta) back through the
+// linearization yields 2*n*Coeff*J^T*(J·delta), the penalty's
+// contribution to the quadratic model's gradient/Hessian-
+// vector product.
+func (s *structuralObjective) stateChangeGrad(delta ConstParamDelta, set sgd.SampleSet) ConstParamDelta {
+	ins, n := s.BatchInputs(set)
+
+	rDelta := ParamRDelta{}
+	for variable, vec := range delta {
+		rDelta[variable] = autofunc.NewRVariable(variable, autofunc.RVector{variable: vec})
+	}
+	out := s.Linearizer.LinearBatchR(rDelta, ins, n)
+
+	upstream := out.ROutput().Copy().Scale(2 * float64(n) * s.Coeff)
+	upstreamR := make(linalg.Vector, len(upstream))
+
+	g := autofunc.Gradient{}
+	for variable := range delta {
+		g[variable] = make(linalg.Vector, len(variable.Vector))
+	}
+	out.PropagateRGradient(upstream, upstreamR, autofunc.RGradient{}, g)
+
+	res := ConstParamDelta{}
+	for variable, vec := range g {
+		res[variable] = vec
+	}
+	return res
+}
+
+func (s *structuralObjective) Quad(delta ConstParamDelta, set sgd.SampleSet) float64 {
+	res := s.WrappedObjective.Quad(delta, set)
+	return res + float64(set.Len())*s.Coeff*s.stateChangeNormSquared(delta, set)
+}
+
+func (s *structuralObjective) QuadGrad(delta ConstParamDelta, set sgd.SampleSet) ConstParamDelta {
+	res := s.WrappedObjective.QuadGrad(delta, set)
+	grad := s.stateChangeGrad(delta, set)
+	for variable, vec := range grad {
+		resVec := res[variable]
+		for i, x := range vec {
+			resVec[i] += x
+		}
+	}
+	return res
+}
+
+func (s *structuralObjective) QuadHessian(delta, solution ConstParamDelta,
+	set sgd.SampleSet) (ConstParamDelta, float64) {
+	res, quadValue := s.WrappedObjective.QuadHessian(delta, solution, set)
+	grad := s.stateChangeGrad(delta, set)
+	for variable, vec := range grad {
+		resVec := res[variable]
+		for i, x := range vec {
+			resVec[i] += x
+		}
+	}
+	quadValue += float64(set.Len()) * s.Coeff * s.stateChangeNormSquared(solution, set)
+	return res, quadValue
+}
+
+func (s *structuralObjective) Objective(delta ConstParamDelta, set sgd.SampleSet) float64 {
+	return s.WrappedObjective.Objective(delta, set)
+}
+
+// TrustRegionDamping adjusts the damping coefficient by
+// bisection: it brackets a coefficient that lands the
+// achieved-vs-predicted reduction ratio in [Low, High]
+// by doubling/halving until both a too-weak and a
+// too-strong coefficient have been observed, then bisects
+// that bracket, rather than applying the fixed 3/2, 2/3
+// multipliers.
+//
+// If Low or High are 0, defaultTrustLow/defaultTrustHigh
+// are used.
+type TrustRegionDamping struct {
+	Low  float64
+	High float64
+
+	haveLow, haveHigh   bool
+	lowCoeff, highCoeff float64
+}
+
+func (*TrustRegionDamping) Term(wrapped Objective, coeff float64) Objective {
+	return ScaledIdentityDamping{}.Term(wrapped, coeff)
+}
+
+func (t *TrustRegionDamping) NextCoeff(prevCoeff, trust float64) float64 {
+	low, high := t.Low, t.High
+	if low == 0 {
+		low = defaultTrustLow
+	}
+	if high == 0 {
+		high = defaultTrustHigh
+	}
+
+	switch {
+	case trust < low:
+		// Damping was too weak (the real reduction undershot
+		// the predicted one): prevCoeff is a lower bound on a
+		// coefficient that would be strong enough.
+		t.lowCoeff, t.haveLow = prevCoeff, true
+		if !t.haveHigh {
+			return prevCoeff * 2
+		}
+		return (t.lowCoeff + t.highCoeff) / 2
+	case trust > high:
+		// Damping was too strong: prevCoeff is an upper bound.
+		t.highCoeff, t.haveHigh = prevCoeff, true
+		if !t.haveLow {
+			return prevCoeff / 2
+		}
+		return (t.lowCoeff + t.highCoeff) / 2
+	default:
+		// Within the target band: the bracket (if any) is now
+		// stale, since prevCoeff itself is a good coefficient.
+		t.haveLow, t.haveHigh = false, false
+		return prevCoeff
+	}
+}
@@ -0,0 +1,200 @@
+package hessfree
+
+import (
+	"github.com/unixpickle/num-analysis/linalg"
+	"github.com/unixpickle/sgd"
+)
+
+const defaultLBFGSHistory = 10
+
+// An InnerSolver selects the algorithm used to minimize
+// the quadratic (or full) subproblem on each mini-batch.
+type InnerSolver int
+
+const (
+	// SolverCG uses linear conjugate gradient, as
+	// described in Martens (2010).
+	SolverCG InnerSolver = iota
+
+	// SolverLBFGS uses limited-memory BFGS with the
+	// standard two-loop recursion.
+	SolverLBFGS
+)
+
+// A lbfgsSolver minimizes an Objective using limited
+// memory BFGS rather than linear CG.
+//
+// It mirrors the cgSolver API so that Trainer can treat
+// both solvers interchangeably.
+type lbfgsSolver struct {
+	Trainer   *Trainer
+	Objective Objective
+	Samples   sgd.SampleSet
+	Solution  ConstParamDelta
+
+	// History is the number of (s, y) pairs to keep.
+	// If 0, defaultLBFGSHistory is used.
+	History int
+
+	grad       ConstParamDelta
+	sHistory   []ConstParamDelta
+	yHistory   []ConstParamDelta
+	rhoHistory []float64
+	lastQuad   float64
+	quadValues []float64
+	startObj   float64
+	iterations int
+}
+
+// Step runs a step of L-BFGS and returns true if another
+// step is desired (i.e. no termination).
+func (l *lbfgsSolver) Step() (shouldContinue bool) {
+	l.initializeIfNeeded()
+
+	if l.grad.magSquared() == 0 {
+		return false
+	}
+
+	direction := l.searchDirection()
+
+	stepSize := l.lineSearch(direction)
+	if stepSize == 0 {
+		return false
+	}
+
+	oldGrad := l.grad.copy()
+
+	l.Solution.addDelta(direction, stepSize)
+
+	newGrad := l.Objective.QuadGrad(l.Solution, l.Samples)
+
+	s := direction.copy()
+	s.scale(stepSize)
+	y := newGrad.copy()
+	y.addDelta(oldGrad, -1)
+
+	l.updateHistory(s, y)
+
+	l.grad = newGrad
+
+	quadValue := l.Objective.Quad(l.Solution, l.Samples)
+	l.quadValues = append(l.quadValues, quadValue)
+	l.lastQuad = quadValue
+	l.iterations++
+
+	l.Trainer.UI.LogCGIteration(stepSize, quadValue)
+
+	return !l.converging()
+}
+
+// Best returns the current L-BFGS solution.
+//
+// Unlike cgSolver, L-BFGS does not backtrack through a
+// series of checkpoints, since its steps are already
+// damped by the line search.
+func (l *lbfgsSolver) Best() ConstParamDelta {
+	return l.Solution
+}
+
+// CurrentSolution returns the solver's current estimate.
+func (l *lbfgsSolver) CurrentSolution() ConstParamDelta {
+	return l.Solution
+}
+
+func (l *lbfgsSolver) initializeIfNeeded() {
+	if l.Solution == nil {
+		l.Solution = l.zeroDelta()
+	}
+	if l.grad == nil {
+		if l.History == 0 {
+			l.History = defaultLBFGSHistory
+		}
+		l.grad = l.Objective.QuadGrad(l.Solution, l.Samples)
+		l.startObj = l.Objective.Objective(ConstParamDelta{}, l.Samples)
+	}
+}
+
+// searchDirection applies the two-loop recursion
+// (Nocedal & Wright) to the current gradient, using the
+// stored (s, y) history as the implicit inverse Hessian
+// approximation.
+func (l *lbfgsSolver) searchDirection() ConstParamDelta {
+	q := l.grad.copy()
+
+	n := len(l.sHistory)
+	alphas := make([]float64, n)
+
+	for i := n - 1; i >= 0; i-- {
+		alphas[i] = l.rhoHistory[i] * l.sHistory[i].dot(q)
+		q.addDelta(l.yHistory[i], -alphas[i])
+	}
+
+	if n > 0 {
+		sLast := l.sHistory[n-1]
+		yLast := l.yHistory[n-1]
+		denom := yLast.dot(yLast)
+		if denom != 0 {
+			q.scale(sLast.dot(yLast) / denom)
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		beta := l.rhoHistory[i] * l.yHistory[i].dot(q)
+		q.addDelta(l.sHistory[i], alphas[i]-beta)
+	}
+
+	q.scale(-1)
+	return q
+}
+
+// lineSearch picks a step size along direction using a
+// simple backtracking search on the quadratic model: the
+// step starts at 1 and is halved, up to 10 times, until
+// Quad decreases. It returns 0 if Quad never decreases.
+func (l *lbfgsSolver) lineSearch(direction ConstParamDelta) float64 {
+	stepSize := 1.0
+	baseValue := l.Objective.Quad(l.Solution, l.Samples)
+	for i := 0; i < 10; i++ {
+		trial := l.Solution.copy()
+		trial.addDelta(direction, stepSize)
+		if l.Objective.Quad(trial, l.Samples) < baseValue {
+			return stepSize
+		}
+		stepSize *= 0.5
+	}
+	return 0
+}
+
+// updateHistory pushes a new (s, y) pair onto the ring
+// buffers, evicting the oldest pair once History is
+// exceeded. Pairs with non-positive curvature (s*y <= 0)
+// are skipped to preserve positive-definiteness of the
+// implicit inverse Hessian.
+func (l *lbfgsSolver) updateHistory(s, y ConstParamDelta) {
+	sy := s.dot(y)
+	if sy <= 0 {
+		return
+	}
+
+	l.sHistory = append(l.sHistory, s)
+	l.yHistory = append(l.yHistory, y)
+	l.rhoHistory = append(l.rhoHistory, 1/sy)
+
+	if len(l.sHistory) > l.History {
+		l.sHistory = l.sHistory[1:]
+		l.yHistory = l.yHistory[1:]
+		l.rhoHistory = l.rhoHistory[1:]
+	}
+}
+
+func (l *lbfgsSolver) converging() bool {
+	return convergenceTest(l.quadValues, l.startObj, l.Trainer.Convergence)
+}
+
+func (l *lbfgsSolver) zeroDelta() ConstParamDelta {
+	delta := ConstParamDelta{}
+	for _, param := range l.Trainer.Learner.Parameters() {
+		delta[param] = make(linalg.Vector, len(param.Vector))
+	}
+	return delta
+}
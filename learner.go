@@ -52,6 +52,12 @@ type DampingLearner struct {
 	// costs for each sample.
 	DampingCoeff float64
 
+	// Strategy determines the damping penalty and how
+	// DampingCoeff evolves between mini-batches.
+	// If nil, ScaledIdentityDamping (the heuristic from
+	// Martens (2010)) is used.
+	Strategy DampingStrategy
+
 	lastObjective Objective
 }
 
@@ -63,25 +69,25 @@ func (d *DampingLearner) MakeObjective() Objective {
 	if d.DampingCoeff == 0 {
 		d.DampingCoeff = defaultDampingCoeff
 	}
-	d.lastObjective = d.WrappedLearner.MakeObjective()
-	return &dampedObjective{
-		WrappedObjective: d.lastObjective,
-		Coeff:            d.DampingCoeff,
+	if d.Strategy == nil {
+		d.Strategy = ScaledIdentityDamping{}
 	}
+	d.lastObjective = d.WrappedLearner.MakeObjective()
+	return d.Strategy.Term(d.lastObjective, d.DampingCoeff)
 }
 
 func (d *DampingLearner) Adjust(delta ConstParamDelta, s sgd.SampleSet) {
 	quadOffset := d.lastObjective.Quad(delta, s)
 	centerVal := d.lastObjective.Objective(ConstParamDelta{}, s)
-	realOffset := d.lastObjective.Objective(ConstParamDelta{}, s)
 	delta.AddToVars()
+	realOffset := d.lastObjective.Objective(ConstParamDelta{}, s)
 
-	trust := (realOffset - centerVal) / (quadOffset - centerVal)
-	if trust < 0.25 {
-		d.DampingCoeff *= 3.0 / 2.0
-	} else if trust > 0.75 {
-		d.DampingCoeff *= 2.0 / 3.0
+	if observer, ok := d.Strategy.(*TikhonovDamping); ok {
+		observer.Observe(d.lastObjective.QuadGrad(ConstParamDelta{}, s))
 	}
+
+	trust := (realOffset - centerVal) / (quadOffset - centerVal)
+	d.DampingCoeff = d.Strategy.NextCoeff(d.DampingCoeff, trust)
 }
 
 type dampedObjective struct {
@@ -0,0 +1,220 @@
+package hessfree
+
+import (
+	"sync"
+
+	"github.com/unixpickle/num-analysis/linalg"
+	"github.com/unixpickle/sgd"
+)
+
+const defaultNumWorkers = 1
+
+// A ParallelObjective wraps an Objective, sharding each
+// mini-batch across NumWorkers goroutines and reducing
+// the per-shard results.
+//
+// This is useful since Objective, QuadGrad, and
+// QuadHessian dominate the runtime of cgSolver.Step for
+// large networks, and their work is embarrassingly
+// parallel across samples.
+type ParallelObjective struct {
+	WrappedObjective Objective
+
+	// NumWorkers is the number of goroutines used to
+	// shard each mini-batch. If 0, defaultNumWorkers
+	// (i.e. no parallelism) is used.
+	NumWorkers int
+
+	scratchOnce sync.Once
+	scratch     chan ConstParamDelta
+}
+
+// Objective evaluates the wrapped objective on each
+// shard and sums the results, since the total cost is
+// the sum of the costs of the individual samples.
+func (p *ParallelObjective) Objective(delta ConstParamDelta, s sgd.SampleSet) float64 {
+	var total float64
+	var mutex sync.Mutex
+	p.forEachShard(s, func(shard sgd.SampleSet) {
+		value := p.WrappedObjective.Objective(delta, shard)
+		mutex.Lock()
+		total += value
+		mutex.Unlock()
+	})
+	return total
+}
+
+// Quad is like Objective, but for the quadratic model.
+func (p *ParallelObjective) Quad(delta ConstParamDelta, s sgd.SampleSet) float64 {
+	var total float64
+	var mutex sync.Mutex
+	p.forEachShard(s, func(shard sgd.SampleSet) {
+		value := p.WrappedObjective.Quad(delta, shard)
+		mutex.Lock()
+		total += value
+		mutex.Unlock()
+	})
+	return total
+}
+
+// QuadGrad evaluates the gradient of the quadratic model
+// on each shard in parallel and reduces the results by
+// element-wise summation.
+func (p *ParallelObjective) QuadGrad(delta ConstParamDelta, s sgd.SampleSet) ConstParamDelta {
+	results := make([]ConstParamDelta, p.numWorkers())
+	p.forEachIndexedShard(s, func(i int, shard sgd.SampleSet) {
+		results[i] = p.WrappedObjective.QuadGrad(delta, shard)
+	})
+	return p.reduce(results)
+}
+
+// QuadHessian evaluates a Gauss-Newton vector product on
+// each shard in parallel and reduces both the resulting
+// deltas and the associated quadratic values.
+func (p *ParallelObjective) QuadHessian(delta, solution ConstParamDelta,
+	s sgd.SampleSet) (ConstParamDelta, float64) {
+	deltaResults := make([]ConstParamDelta, p.numWorkers())
+	quadResults := make([]float64, p.numWorkers())
+	p.forEachIndexedShard(s, func(i int, shard sgd.SampleSet) {
+		deltaResults[i], quadResults[i] = p.WrappedObjective.QuadHessian(delta, solution, shard)
+	})
+	var totalQuad float64
+	for _, q := range quadResults {
+		totalQuad += q
+	}
+	return p.reduce(deltaResults), totalQuad
+}
+
+// numWorkers returns NumWorkers, or defaultNumWorkers if
+// it is unset.
+func (p *ParallelObjective) numWorkers() int {
+	if p.NumWorkers == 0 {
+		return defaultNumWorkers
+	}
+	return p.NumWorkers
+}
+
+// shards splits s into at most numWorkers() contiguous,
+// ordered subsets. The order is fixed across calls so that
+// reduce() always sums shards in the same sequence,
+// keeping results deterministic.
+func (p *ParallelObjective) shards(s sgd.SampleSet) []sgd.SampleSet {
+	n := p.numWorkers()
+	if n > s.Len() {
+		n = s.Len()
+	}
+	if n <= 1 {
+		return []sgd.SampleSet{s}
+	}
+
+	chunk := (s.Len() + n - 1) / n
+	var res []sgd.SampleSet
+	for i := 0; i < s.Len(); i += chunk {
+		end := i + chunk
+		if end > s.Len() {
+			end = s.Len()
+		}
+		res = append(res, s.Subset(i, end))
+	}
+	return res
+}
+
+// forEachShard runs f on every shard of s in parallel,
+// blocking until all shards are processed.
+func (p *ParallelObjective) forEachShard(s sgd.SampleSet, f func(sgd.SampleSet)) {
+	p.forEachIndexedShard(s, func(_ int, shard sgd.SampleSet) {
+		f(shard)
+	})
+}
+
+// forEachIndexedShard is like forEachShard, but f also
+// receives the shard's position in shard order, so that
+// callers can write results into a pre-sized slice
+// without needing a mutex.
+func (p *ParallelObjective) forEachIndexedShard(s sgd.SampleSet, f func(int, sgd.SampleSet)) {
+	shards := p.shards(s)
+	var wg sync.WaitGroup
+	wg.Add(len(shards))
+	for i, shard := range shards {
+		go func(i int, shard sgd.SampleSet) {
+			defer wg.Done()
+			f(i, shard)
+		}(i, shard)
+	}
+	wg.Wait()
+}
+
+// reduce sums a list of per-shard ConstParamDeltas into
+// an accumulator drawn from the scratch pool, so that
+// repeated calls (e.g. once per CG iteration) don't each
+// allocate a fresh map.
+//
+// The returned delta is owned by the caller until it is
+// passed back via Release; reduce never reuses a buffer
+// that hasn't been released.
+func (p *ParallelObjective) reduce(deltas []ConstParamDelta) ConstParamDelta {
+	acc := p.borrowScratch()
+	for _, d := range deltas {
+		if d == nil {
+			continue
+		}
+		acc.growToMatch(d)
+		acc.addDelta(d, 1)
+	}
+	return acc
+}
+
+// borrowScratch takes a scratch buffer from the pool,
+// allocating one lazily if none is available.
+func (p *ParallelObjective) borrowScratch() ConstParamDelta {
+	p.scratchOnce.Do(func() {
+		p.scratch = make(chan ConstParamDelta, p.numWorkers())
+	})
+
+	select {
+	case buf := <-p.scratch:
+		return buf
+	default:
+		return ConstParamDelta{}
+	}
+}
+
+// Release returns a ConstParamDelta previously produced
+// by QuadGrad or QuadHessian to the scratch pool, so a
+// later call can reuse its backing storage instead of
+// allocating. Callers that no longer need the delta may
+// call this, but are not required to.
+func (p *ParallelObjective) Release(d ConstParamDelta) {
+	p.scratchOnce.Do(func() {
+		p.scratch = make(chan ConstParamDelta, p.numWorkers())
+	})
+	for _, vec := range d {
+		for i := range vec {
+			vec[i] = 0
+		}
+	}
+	select {
+	case p.scratch <- d:
+	default:
+	}
+}
+
+// releaseDelta returns d to obj's scratch pool if obj is a
+// *ParallelObjective, so solvers can release deltas they no
+// longer need without caring whether objective sharding is
+// actually in use. It is a no-op for any other Objective.
+func releaseDelta(obj Objective, d ConstParamDelta) {
+	if p, ok := obj.(*ParallelObjective); ok {
+		p.Release(d)
+	}
+}
+
+// growToMatch ensures acc has a zeroed vector for every
+// variable present in like, allocating as needed.
+func (acc ConstParamDelta) growToMatch(like ConstParamDelta) {
+	for variable, vec := range like {
+		if old, ok := acc[variable]; !ok || len(old) != len(vec) {
+			acc[variable] = make(linalg.Vector, len(vec))
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package hessfree
+
+import (
+	"github.com/unixpickle/autofunc"
+	"github.com/unixpickle/sgd"
+)
+
+// A Precision selects the numeric representation used
+// for the CG accumulators (Solution, residual,
+// projectedResidual, hessianProduct) inside a mini-batch.
+type Precision int
+
+const (
+	// Float64 keeps all CG accumulators as linalg.Vector
+	// (float64). This is the default.
+	Float64 Precision = iota
+
+	// Mixed keeps the CG accumulators in float32 (via
+	// HalfDelta), promoting to float64 only for the inner
+	// dot products (residualMag2, projHessianMag) where
+	// catastrophic cancellation would otherwise bite.
+	// This halves the memory bandwidth of the CG loop's
+	// vector arithmetic, which dominates runtime for large
+	// networks.
+	Mixed
+)
+
+// A HalfDelta is a ConstParamDelta whose per-variable
+// vectors are stored as float32 rather than float64.
+// It implements the same dot/scale/addDelta/magSquared
+// methods as ConstParamDelta so that mixedCgSolver can
+// mirror cgSolver's arithmetic.
+type HalfDelta map[*autofunc.Variable][]float32
+
+// dot computes the dot product of h and o, accumulating
+// in float64 to avoid losing precision across many
+// float32 terms.
+func (h HalfDelta) dot(o HalfDelta) float64 {
+	var sum float64
+	for variable, vec := range h {
+		oVec := o[variable]
+		for i, x := range vec {
+			sum += float64(x) * float64(oVec[i])
+		}
+	}
+	return sum
+}
+
+// magSquared is equivalent to h.dot(h).
+func (h HalfDelta) magSquared() float64 {
+	return h.dot(h)
+}
+
+// scale multiplies every entry of h by s in place.
+func (h HalfDelta) scale(s float64) {
+	s32 := float32(s)
+	for _, vec := range h {
+		for i := range vec {
+			vec[i] *= s32
+		}
+	}
+}
+
+// addDelta adds scaler*o to h in place.
+func (h HalfDelta) addDelta(o HalfDelta, scaler float64) {
+	s32 := float32(scaler)
+	for variable, vec := range h {
+		oVec := o[variable]
+		for i := range vec {
+			vec[i] += s32 * oVec[i]
+		}
+	}
+}
+
+// copy returns a deep copy of h.
+func (h HalfDelta) copy() HalfDelta {
+	res := make(HalfDelta, len(h))
+	for variable, vec := range h {
+		vecCopy := make([]float32, len(vec))
+		copy(vecCopy, vec)
+		res[variable] = vecCopy
+	}
+	return res
+}
+
+// toConstParamDelta promotes h to a full float64
+// ConstParamDelta, e.g. before passing it to an Objective.
+func (h HalfDelta) toConstParamDelta() ConstParamDelta {
+	res := ConstParamDelta{}
+	for variable, vec := range h {
+		vec64 := make([]float64, len(vec))
+		for i, x := range vec {
+			vec64[i] = float64(x)
+		}
+		res[variable] = vec64
+	}
+	return res
+}
+
+// halfFromConstParamDelta demotes d to a HalfDelta,
+// truncating each entry to float32.
+func halfFromConstParamDelta(d ConstParamDelta) HalfDelta {
+	res := make(HalfDelta, len(d))
+	for variable, vec := range d {
+		vec32 := make([]float32, len(vec))
+		for i, x := range vec {
+			vec32[i] = float32(x)
+		}
+		res[variable] = vec32
+	}
+	return res
+}
+
+// A mixedCgSolver is a linear CG solver, like cgSolver,
+// except that its accumulators are stored as HalfDelta
+// (float32) rather than ConstParamDelta (float64). Only
+// the scalar dot products used to pick step sizes are
+// computed in float64.
+//
+// Objective still operates on float64 ConstParamDeltas,
+// so mixedCgSolver promotes/demotes at each call boundary.
+type mixedCgSolver struct {
+	Trainer   *Trainer
+	Objective Objective
+	Samples   sgd.SampleSet
+	Solution  HalfDelta
+
+	// Preconditioner, if non-nil, is applied like in
+	// cgSolver: the projected residual is derived from
+	// M^-1*r rather than r directly. Apply/Observe still
+	// operate on float64 ConstParamDeltas, so the residual
+	// is promoted/demoted around the call.
+	Preconditioner Preconditioner
+
+	residual               HalfDelta
+	preconditionedResidual HalfDelta
+	projectedResidual      HalfDelta
+	residualMag2           float64
+	hessianProduct         HalfDelta
+
+	justBacktracked bool
+	backtrackCount  int
+	backtrackDeltas []HalfDelta
+	backtrackValues []float64
+
+	startObjective float64
+	quadValues     []float64
+}
+
+// Step runs a step of (optionally preconditioned) CG in
+// mixed precision and returns true if another step is
+// desired.
+func (c *mixedCgSolver) Step() (shouldContinue bool) {
+	c.initializeIfNeeded()
+
+	projHessianMag := c.projectedResidual.dot(c.hessianProduct)
+	if projHessianMag == 0 || c.residualMag2 == 0 {
+		return false
+	}
+
+	c.justBacktracked = false
+	stepSize := c.residualMag2 / projHessianMag
+
+	c.Solution.addDelta(c.projectedResidual, stepSize)
+
+	oldRZ := c.residualMag2
+	c.residual.addDelta(c.hessianProduct, -stepSize)
+	c.preconditionedResidual = c.precondition(c.residual)
+	c.residualMag2 = c.residual.dot(c.preconditionedResidual)
+
+	beta := c.residualMag2 / oldRZ
+	c.projectedResidual.scale(beta)
+	c.projectedResidual.addDelta(c.preconditionedResidual, 1)
+
+	hessianProduct, quadValue := c.Objective.QuadHessian(
+		c.projectedResidual.toConstParamDelta(), c.Solution.toConstParamDelta(), c.Samples)
+	c.hessianProduct = halfFromConstParamDelta(hessianProduct)
+	releaseDelta(c.Objective, hessianProduct)
+	c.quadValues = append(c.quadValues, quadValue)
+
+	c.Trainer.UI.LogCGIteration(stepSize, quadValue)
+
+	if c.converging() {
+		return false
+	}
+
+	c.updateBacktracking()
+
+	return true
+}
+
+// Best returns the best known solution, including the
+// current solution and all the backtracked ones.
+func (c *mixedCgSolver) Best() ConstParamDelta {
+	if !c.justBacktracked {
+		btValue := c.Objective.Objective(c.Solution.toConstParamDelta(), c.Samples)
+		c.backtrackDeltas = append(c.backtrackDeltas, c.Solution)
+		c.backtrackValues = append(c.backtrackValues, btValue)
+		c.justBacktracked = true
+	}
+	var bestVal float64
+	var bestDelta HalfDelta
+	for i, v := range c.backtrackValues {
+		if v < bestVal || i == 0 {
+			bestDelta = c.backtrackDeltas[i]
+			bestVal = v
+		}
+	}
+	return bestDelta.toConstParamDelta()
+}
+
+// CurrentSolution returns the solver's current estimate,
+// promoted to a float64 ConstParamDelta.
+func (c *mixedCgSolver) CurrentSolution() ConstParamDelta {
+	return c.Solution.toConstParamDelta()
+}
+
+func (c *mixedCgSolver) initializeIfNeeded() {
+	if c.Solution == nil {
+		c.Solution = c.zeroDelta()
+	}
+	if c.residual == nil {
+		grad := c.Objective.QuadGrad(c.Solution.toConstParamDelta(), c.Samples)
+		c.residual = halfFromConstParamDelta(grad)
+		releaseDelta(c.Objective, grad)
+		c.residual.scale(-1)
+		c.preconditionedResidual = c.precondition(c.residual)
+		c.projectedResidual = c.preconditionedResidual.copy()
+		c.residualMag2 = c.residual.dot(c.preconditionedResidual)
+		c.startObjective = c.Objective.Objective(ConstParamDelta{}, c.Samples)
+
+		hessianProduct, quadValue := c.Objective.QuadHessian(
+			c.projectedResidual.toConstParamDelta(), c.Solution.toConstParamDelta(), c.Samples)
+		c.hessianProduct = halfFromConstParamDelta(hessianProduct)
+		releaseDelta(c.Objective, hessianProduct)
+		c.Trainer.UI.LogCGStart(quadValue, c.startObjective)
+	}
+}
+
+func (c *mixedCgSolver) converging() bool {
+	return convergenceTest(c.quadValues, c.startObjective, c.Trainer.Convergence)
+}
+
+func (c *mixedCgSolver) updateBacktracking() {
+	if !backtrackDue(len(c.quadValues), c.Trainer.BacktrackRate, &c.backtrackCount) {
+		return
+	}
+
+	btValue := c.Objective.Objective(c.Solution.toConstParamDelta(), c.Samples)
+	c.backtrackDeltas = append(c.backtrackDeltas, c.Solution.copy())
+	c.backtrackValues = append(c.backtrackValues, btValue)
+	c.justBacktracked = true
+}
+
+func (c *mixedCgSolver) zeroDelta() HalfDelta {
+	delta := HalfDelta{}
+	for _, param := range c.Trainer.Learner.Parameters() {
+		delta[param] = make([]float32, len(param.Vector))
+	}
+	return delta
+}
+
+// precondition applies c.Preconditioner to r, promoting
+// to float64 and demoting back to float32 around the
+// call, or returns r unchanged if no Preconditioner is
+// set (i.e. standard, unpreconditioned CG).
+func (c *mixedCgSolver) precondition(r HalfDelta) HalfDelta {
+	if c.Preconditioner == nil {
+		return r.copy()
+	}
+	return halfFromConstParamDelta(c.Preconditioner.Apply(r.toConstParamDelta()))
+}
@@ -0,0 +1,164 @@
+package hessfree
+
+import (
+	"math"
+	"testing"
+
+	"github.com/unixpickle/autofunc"
+	"github.com/unixpickle/num-analysis/linalg"
+	"github.com/unixpickle/sgd"
+)
+
+// fakeSampleSet is a minimal sgd.SampleSet with no
+// per-sample payload: quadraticObjective below only needs
+// a sample count, not the samples themselves.
+type fakeSampleSet int
+
+func (f fakeSampleSet) Len() int { return int(f) }
+
+func (f fakeSampleSet) Swap(i, j int) {}
+
+func (f fakeSampleSet) Copy() sgd.SampleSet { return f }
+
+func (f fakeSampleSet) Subset(i, j int) sgd.SampleSet { return fakeSampleSet(j - i) }
+
+// fakeUI stops Trainer.Train after maxEpoch epochs and
+// otherwise ignores everything it's told.
+type fakeUI struct {
+	maxEpoch int
+	epoch    int
+}
+
+func (f *fakeUI) ShouldStop() bool { return f.epoch >= f.maxEpoch }
+
+func (f *fakeUI) LogNewMiniBatch(epoch, miniBatch int) { f.epoch = epoch }
+
+func (f *fakeUI) LogCGIteration(stepSize, quadValue float64) {}
+
+func (f *fakeUI) LogCGStart(quadValue, startObjective float64) {}
+
+func (f *fakeUI) LogCheckpointError(err error) {}
+
+// quadraticLearner/quadraticObjective is a tiny synthetic
+// bowl, f(θ) = Σ scaler*(θ_i-target_i)², standing in for a
+// real MLP: this package doesn't ship any network-layer
+// primitives to build one from. The bowl is exactly
+// quadratic, so Quad/QuadGrad/QuadHessian are exact and CG
+// converges to the minimum in a handful of iterations under
+// either Precision, making it a reasonable stand-in for
+// bounding the error the Mixed path introduces.
+type quadraticLearner struct {
+	params []*autofunc.Variable
+	target []float64
+}
+
+func newQuadraticLearner(target []float64) *quadraticLearner {
+	params := make([]*autofunc.Variable, len(target))
+	for i := range target {
+		params[i] = &autofunc.Variable{Vector: linalg.Vector{0}}
+	}
+	return &quadraticLearner{params: params, target: target}
+}
+
+func (q *quadraticLearner) Parameters() []*autofunc.Variable {
+	return q.params
+}
+
+func (q *quadraticLearner) MakeObjective() Objective {
+	return &quadraticObjective{params: q.params, target: q.target}
+}
+
+func (q *quadraticLearner) Adjust(d ConstParamDelta, s sgd.SampleSet) {
+	for _, p := range q.params {
+		if vec, ok := d[p]; ok {
+			p.Vector[0] += vec[0]
+		}
+	}
+}
+
+type quadraticObjective struct {
+	params []*autofunc.Variable
+	target []float64
+}
+
+func (q *quadraticObjective) deltaFor(delta ConstParamDelta, p *autofunc.Variable) float64 {
+	if vec, ok := delta[p]; ok && len(vec) > 0 {
+		return vec[0]
+	}
+	return 0
+}
+
+func (q *quadraticObjective) Quad(delta ConstParamDelta, s sgd.SampleSet) float64 {
+	scaler := float64(s.Len())
+	var total float64
+	for i, p := range q.params {
+		x := p.Vector[0] + q.deltaFor(delta, p) - q.target[i]
+		total += scaler * x * x
+	}
+	return total
+}
+
+func (q *quadraticObjective) QuadGrad(delta ConstParamDelta, s sgd.SampleSet) ConstParamDelta {
+	scaler := float64(s.Len())
+	res := ConstParamDelta{}
+	for i, p := range q.params {
+		x := p.Vector[0] + q.deltaFor(delta, p) - q.target[i]
+		res[p] = linalg.Vector{2 * scaler * x}
+	}
+	return res
+}
+
+func (q *quadraticObjective) QuadHessian(delta, solution ConstParamDelta,
+	s sgd.SampleSet) (ConstParamDelta, float64) {
+	scaler := float64(s.Len())
+	res := ConstParamDelta{}
+	for _, p := range q.params {
+		res[p] = linalg.Vector{2 * scaler * q.deltaFor(delta, p)}
+	}
+	return res, q.Quad(solution, s)
+}
+
+func (q *quadraticObjective) Objective(delta ConstParamDelta, s sgd.SampleSet) float64 {
+	return q.Quad(delta, s)
+}
+
+// TestMixedPrecisionConvergence trains the same quadratic
+// bowl under Precision Float64 and Precision Mixed and
+// checks that the float32 accumulators used by the Mixed
+// path don't cost more than a small, bounded amount of
+// accuracy relative to the Float64 path.
+func TestMixedPrecisionConvergence(t *testing.T) {
+	target := []float64{1, -2, 0.5, 3}
+	samples := fakeSampleSet(8)
+
+	runTrainer := func(precision Precision) []float64 {
+		learner := newQuadraticLearner(target)
+		trainer := &Trainer{
+			Learner:   learner,
+			Samples:   samples,
+			BatchSize: samples.Len(),
+			UI:        &fakeUI{maxEpoch: 20},
+			Precision: precision,
+		}
+		trainer.Train()
+
+		result := make([]float64, len(learner.params))
+		for i, p := range learner.params {
+			result[i] = p.Vector[0]
+		}
+		return result
+	}
+
+	float64Result := runTrainer(Float64)
+	mixedResult := runTrainer(Mixed)
+
+	const tolerance = 1e-2
+	for i := range target {
+		diff := math.Abs(float64Result[i] - mixedResult[i])
+		if diff > tolerance {
+			t.Errorf("param %d: float64 solution %v and mixed-precision solution %v "+
+				"differ by %v, exceeding tolerance %v (target %v)",
+				i, float64Result[i], mixedResult[i], diff, tolerance, target[i])
+		}
+	}
+}
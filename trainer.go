@@ -2,6 +2,8 @@ package hessfree
 
 import (
 	"math"
+	"os"
+	"time"
 
 	"github.com/unixpickle/num-analysis/linalg"
 	"github.com/unixpickle/sgd"
@@ -48,16 +50,129 @@ type Trainer struct {
 	// how frequently backtracking checkpoints are made.
 	// If this is 0, the default from Martens (2010) is used.
 	BacktrackRate float64
+
+	// InnerSolver selects the algorithm used to minimize
+	// each mini-batch's subproblem.
+	// If this is the zero value, SolverCG is used.
+	InnerSolver InnerSolver
+
+	// NumWorkers is the number of goroutines used to shard
+	// each mini-batch when evaluating Objective, QuadGrad,
+	// and QuadHessian. If this is 0 or 1, objectives are
+	// evaluated on a single goroutine.
+	NumWorkers int
+
+	// Preconditioner, if non-nil, is used to precondition
+	// the CG recursion (SolverCG only). It is updated with
+	// the gradient of each mini-batch after Adjust is
+	// called.
+	Preconditioner Preconditioner
+
+	// CheckpointEvery, if non-zero, causes Train to write a
+	// checkpoint to CheckpointPath (via SaveCheckpoint) at
+	// most this often, checked between mini-batches.
+	CheckpointEvery time.Duration
+
+	// CheckpointPath is the file Train writes checkpoints
+	// to when CheckpointEvery is non-zero.
+	CheckpointPath string
+
+	// Precision selects the numeric representation of the
+	// CG accumulators. If this is the zero value, Float64
+	// is used. It has no effect when InnerSolver is
+	// SolverLBFGS. Preconditioner is honored under either
+	// Precision setting.
+	Precision Precision
+
+	epoch          int
+	miniBatch      int
+	randSeed       int64
+	lastSolution   ConstParamDelta
+	lastCheckpoint time.Time
+}
+
+// innerSolver is implemented by both cgSolver and
+// lbfgsSolver, allowing Trainer to drive either one
+// through the same mini-batch loop.
+type innerSolver interface {
+	Step() bool
+	Best() ConstParamDelta
+	CurrentSolution() ConstParamDelta
+}
+
+// convergenceTest implements the relative-change
+// convergence criterion from Martens (2010), shared by
+// cgSolver, lbfgsSolver, and mixedCgSolver: the solver stops
+// once progress over the last k iterations (k scaled by
+// conv.KScale, floored at conv.MinK) has slowed below
+// conv.Epsilon per iteration.
+func convergenceTest(quadValues []float64, startObjective float64, conv ConvergenceCriteria) bool {
+	if len(quadValues) < 2 || quadValues[len(quadValues)-1] > startObjective {
+		return false
+	}
+
+	kScale := conv.KScale
+	minK := conv.MinK
+	eps := conv.Epsilon
+	if kScale == 0 {
+		kScale = defaultConvergenceKScale
+	}
+	if minK == 0 {
+		minK = defaultConvergenceMinK
+	}
+	if eps == 0 {
+		eps = defaultConvergenceEpsilon
+	}
+
+	k := int(math.Max(minK, kScale*float64(len(quadValues))))
+	if k >= len(quadValues) {
+		return false
+	}
+
+	currentImprovement := quadValues[len(quadValues)-1] - startObjective
+	oldImprovement := quadValues[len(quadValues)-1-k] - startObjective
+	return (currentImprovement-oldImprovement)/currentImprovement < float64(k)*eps
+}
+
+// backtrackDue reports whether a new backtracking
+// checkpoint is due after doneIters iterations, advancing
+// *count (the number of checkpoints taken so far) if so.
+// Checkpoints follow the exponential schedule from Martens
+// (2010): one is taken once doneIters reaches rate^*count,
+// so checkpoints get progressively further apart.
+func backtrackDue(doneIters int, rate float64, count *int) bool {
+	if rate == 0 {
+		rate = defaultBacktrackRate
+	}
+	if int(math.Pow(rate, float64(*count))) > doneIters {
+		return false
+	}
+	for int(math.Pow(rate, float64(*count))) <= doneIters {
+		*count++
+	}
+	return true
+}
+
+// makeObjective creates the Objective for a mini-batch,
+// wrapping it in a ParallelObjective if the Trainer is
+// configured to shard evaluation across workers.
+func (t *Trainer) makeObjective() Objective {
+	objective := t.Learner.MakeObjective()
+	if t.NumWorkers > 1 {
+		objective = &ParallelObjective{
+			WrappedObjective: objective,
+			NumWorkers:       t.NumWorkers,
+		}
+	}
+	return objective
 }
 
 func (t *Trainer) Train() {
-	var epoch int
-	var lastSolution ConstParamDelta
 	for {
 		shuffled := t.Samples.Copy()
-		sgd.ShuffleSampleSet(shuffled)
+		t.seededShuffle(shuffled)
 
-		var miniBatch int
+		t.miniBatch = 0
 		for i := 0; i < shuffled.Len(); i += t.BatchSize {
 			bs := t.BatchSize
 			if bs > shuffled.Len()-i {
@@ -67,13 +182,39 @@ func (t *Trainer) Train() {
 			if t.UI.ShouldStop() {
 				return
 			}
-			t.UI.LogNewMiniBatch(epoch, miniBatch)
-
-			solver := cgSolver{
-				Trainer:   t,
-				Objective: t.Learner.MakeObjective(),
-				Samples:   subset,
-				Solution:  lastSolution,
+			t.UI.LogNewMiniBatch(t.epoch, t.miniBatch)
+
+			objective := t.makeObjective()
+
+			var solver innerSolver
+			switch {
+			case t.InnerSolver == SolverLBFGS:
+				solver = &lbfgsSolver{
+					Trainer:   t,
+					Objective: objective,
+					Samples:   subset,
+					Solution:  t.lastSolution,
+				}
+			case t.Precision == Mixed:
+				var initSolution HalfDelta
+				if t.lastSolution != nil {
+					initSolution = halfFromConstParamDelta(t.lastSolution)
+				}
+				solver = &mixedCgSolver{
+					Trainer:        t,
+					Objective:      objective,
+					Samples:        subset,
+					Solution:       initSolution,
+					Preconditioner: t.Preconditioner,
+				}
+			default:
+				solver = &cgSolver{
+					Trainer:        t,
+					Objective:      objective,
+					Samples:        subset,
+					Solution:       t.lastSolution,
+					Preconditioner: t.Preconditioner,
+				}
 			}
 			for solver.Step() {
 				if t.UI.ShouldStop() {
@@ -81,13 +222,48 @@ func (t *Trainer) Train() {
 				}
 			}
 			useDelta := solver.Best()
-			lastSolution = solver.Solution
-			t.Learner.Adjust(useDelta, lastSolution, subset)
+			t.lastSolution = solver.CurrentSolution()
+			t.Learner.Adjust(useDelta, subset)
+
+			if t.Preconditioner != nil {
+				t.Preconditioner.Observe(objective.QuadGrad(ConstParamDelta{}, subset))
+			}
 
-			miniBatch++
+			t.maybeCheckpoint()
+
+			t.miniBatch++
 		}
-		epoch++
+		t.epoch++
+	}
+}
+
+// maybeCheckpoint writes a checkpoint to CheckpointPath
+// if CheckpointEvery has elapsed since the last one.
+func (t *Trainer) maybeCheckpoint() {
+	if t.CheckpointEvery == 0 || t.CheckpointPath == "" {
+		return
+	}
+	if !t.lastCheckpoint.IsZero() && time.Since(t.lastCheckpoint) < t.CheckpointEvery {
+		return
+	}
+
+	tmpPath := t.CheckpointPath + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		t.UI.LogCheckpointError(err)
+		return
 	}
+	err = t.SaveCheckpoint(f)
+	f.Close()
+	if err == nil {
+		err = os.Rename(tmpPath, t.CheckpointPath)
+	}
+	if err != nil {
+		t.UI.LogCheckpointError(err)
+		return
+	}
+
+	t.lastCheckpoint = time.Now()
 }
 
 type cgSolver struct {
@@ -96,11 +272,17 @@ type cgSolver struct {
 	Samples   sgd.SampleSet
 	Solution  ConstParamDelta
 
-	residual          ConstParamDelta
-	projectedResidual ConstParamDelta
-	residualMag2      float64
-	hessianProduct    ConstParamDelta
-	lastQuadValue     float64
+	// Preconditioner, if non-nil, turns this into a
+	// preconditioned CG recursion: the projected residual
+	// is derived from M^-1*r rather than r directly.
+	Preconditioner Preconditioner
+
+	residual               ConstParamDelta
+	preconditionedResidual ConstParamDelta
+	projectedResidual      ConstParamDelta
+	residualMag2           float64
+	hessianProduct         ConstParamDelta
+	lastQuadValue          float64
 
 	justBacktracked bool
 	backtrackCount  int
@@ -126,18 +308,21 @@ func (c *cgSolver) Step() (shouldContinue bool) {
 
 	c.Solution.addDelta(c.projectedResidual, stepSize)
 
-	oldRMag2 := c.residualMag2
+	oldRZ := c.residualMag2
 	c.residual.addDelta(c.hessianProduct, -stepSize)
-	c.residualMag2 = c.residual.magSquared()
+	c.preconditionedResidual = c.precondition(c.residual)
+	c.residualMag2 = c.residual.dot(c.preconditionedResidual)
 
-	beta := c.residualMag2 / oldRMag2
+	beta := c.residualMag2 / oldRZ
 	c.projectedResidual.scale(beta)
-	c.projectedResidual.addDelta(c.residual, 1)
+	c.projectedResidual.addDelta(c.preconditionedResidual, 1)
 
+	oldHessianProduct := c.hessianProduct
 	var quadValue float64
 	c.hessianProduct, quadValue = c.Objective.QuadHessian(c.projectedResidual,
 		c.Solution, c.Samples)
 	c.quadValues = append(c.quadValues, quadValue)
+	releaseDelta(c.Objective, oldHessianProduct)
 
 	c.Trainer.UI.LogCGIteration(stepSize, quadValue)
 
@@ -170,6 +355,12 @@ func (c *cgSolver) Best() ConstParamDelta {
 	return bestDelta
 }
 
+// CurrentSolution returns the solver's current estimate,
+// independent of any backtracking checkpoints.
+func (c *cgSolver) CurrentSolution() ConstParamDelta {
+	return c.Solution
+}
+
 func (c *cgSolver) initializeIfNeeded() {
 	if c.Solution == nil {
 		c.Solution = c.zeroDelta()
@@ -177,8 +368,9 @@ func (c *cgSolver) initializeIfNeeded() {
 	if c.residual == nil {
 		c.residual = c.Objective.QuadGrad(c.Solution, c.Samples)
 		c.residual.scale(-1)
-		c.projectedResidual = c.residual.copy()
-		c.residualMag2 = c.residual.magSquared()
+		c.preconditionedResidual = c.precondition(c.residual)
+		c.projectedResidual = c.preconditionedResidual.copy()
+		c.residualMag2 = c.residual.dot(c.preconditionedResidual)
 		c.startObjective = c.Objective.Objective(ConstParamDelta{}, c.Samples)
 
 		var quadValue float64
@@ -189,46 +381,13 @@ func (c *cgSolver) initializeIfNeeded() {
 }
 
 func (c *cgSolver) converging() bool {
-	if len(c.quadValues) < 2 || c.quadValues[len(c.quadValues)-1] > c.startObjective {
-		return false
-	}
-
-	kScale := c.Trainer.Convergence.KScale
-	minK := c.Trainer.Convergence.MinK
-	eps := c.Trainer.Convergence.Epsilon
-	if kScale == 0 {
-		kScale = defaultConvergenceKScale
-	}
-	if minK == 0 {
-		minK = defaultConvergenceMinK
-	}
-	if eps == 0 {
-		eps = defaultConvergenceEpsilon
-	}
-
-	k := int(math.Max(minK, kScale*float64(len(c.quadValues))))
-	if k >= len(c.quadValues) {
-		return false
-	}
-
-	currentImprovement := (c.quadValues[len(c.quadValues)-1] - c.startObjective)
-	oldImprovement := (c.quadValues[len(c.quadValues)-1-k] - c.startObjective)
-	return (currentImprovement-oldImprovement)/currentImprovement < float64(k)*eps
+	return convergenceTest(c.quadValues, c.startObjective, c.Trainer.Convergence)
 }
 
 func (c *cgSolver) updateBacktracking() {
-	doneIters := len(c.quadValues)
-	btRate := c.Trainer.BacktrackRate
-	if btRate == 0 {
-		btRate = defaultBacktrackRate
-	}
-	expValue := math.Pow(btRate, float64(c.backtrackCount))
-	if int(expValue) > doneIters {
+	if !backtrackDue(len(c.quadValues), c.Trainer.BacktrackRate, &c.backtrackCount) {
 		return
 	}
-	for int(math.Pow(btRate, float64(c.backtrackCount))) <= doneIters {
-		c.backtrackCount++
-	}
 
 	btValue := c.Objective.Objective(c.Solution, c.Samples)
 	c.backtrackDeltas = append(c.backtrackDeltas, c.Solution.copy())
@@ -243,3 +402,13 @@ func (c *cgSolver) zeroDelta() ConstParamDelta {
 	}
 	return delta
 }
+
+// precondition applies c.Preconditioner to r, or returns
+// r unchanged if no Preconditioner is set (i.e. standard,
+// unpreconditioned CG).
+func (c *cgSolver) precondition(r ConstParamDelta) ConstParamDelta {
+	if c.Preconditioner == nil {
+		return r.copy()
+	}
+	return c.Preconditioner.Apply(r)
+}